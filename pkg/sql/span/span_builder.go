@@ -11,6 +11,11 @@
 package span
 
 import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/config/zonepb"
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql/opt/constraint"
@@ -40,15 +45,49 @@ type Builder struct {
 	interstices [][]byte
 
 	neededFamilies []sqlbase.FamilyID
+
+	// nodeLocality and localityFilterSet are used by MaybeSplitSpanByPartition
+	// to restrict and tag spans by partition. See SetLocalityFilter.
+	nodeLocality      roachpb.Locality
+	localityFilterSet bool
+	// partitionZoneConfigs holds the zone config for each partition (and
+	// subpartition) of the Builder's index, keyed by partition name. It is
+	// populated by SetPartitionZoneConfigs and consulted by
+	// MaybeSplitSpanByPartition to decide whether a partition's leaseholder
+	// preferences match nodeLocality.
+	partitionZoneConfigs map[string]*zonepb.ZoneConfig
+
+	// shardBucketCount is the number of shard buckets of a hash-sharded index,
+	// or 0 if the index isn't hash-sharded or shard fan-out was disabled with
+	// DisableShardedIndexFanOut. See SpansFromConstraint and SpanFromDatumRow.
+	shardBucketCount int32
+}
+
+// Option configures optional Builder behavior. Pass options to MakeBuilder.
+type Option func(*Builder)
+
+// DisableShardedIndexFanOut instructs the Builder not to automatically fan a
+// constraint on a hash-sharded index out into one span per shard bucket.
+// Callers that pass this option are responsible for constraining or encoding
+// the shard column themselves; without it, the Builder will otherwise
+// silently prepend shard values on the caller's behalf.
+func DisableShardedIndexFanOut() Option {
+	return func(s *Builder) {
+		s.shardBucketCount = 0
+	}
 }
 
 // Use some functions that aren't needed right now to make the linter happy.
 var _ = (*Builder).UnsetNeededColumns
 var _ = (*Builder).SetNeededFamilies
 var _ = (*Builder).UnsetNeededFamilies
+var _ = (*Builder).UnsetLocalityFilter
 
-// MakeBuilder creates a Builder for a table and index.
-func MakeBuilder(table *sqlbase.TableDescriptor, index *sqlbase.IndexDescriptor) *Builder {
+// MakeBuilder creates a Builder for a table and index. By default, a
+// constraint against a hash-sharded index's non-shard columns is
+// automatically fanned out into one span per shard bucket; pass
+// DisableShardedIndexFanOut to opt out.
+func MakeBuilder(table *sqlbase.TableDescriptor, index *sqlbase.IndexDescriptor, opts ...Option) *Builder {
 	s := &Builder{
 		table:          table,
 		index:          index,
@@ -57,6 +96,10 @@ func MakeBuilder(table *sqlbase.TableDescriptor, index *sqlbase.IndexDescriptor)
 		neededFamilies: nil,
 	}
 
+	if index.Sharded.IsSharded {
+		s.shardBucketCount = index.Sharded.ShardBuckets
+	}
+
 	var columnIDs sqlbase.ColumnIDs
 	columnIDs, s.indexColDirs = index.FullColumnIDs()
 	s.indexColTypes = make([]types.T, len(columnIDs))
@@ -92,6 +135,10 @@ func MakeBuilder(table *sqlbase.TableDescriptor, index *sqlbase.IndexDescriptor)
 			encoding.EncodeUvarintAscending(s.interstices[sharedPrefixLen], uint64(index.ID))
 	}
 
+	for _, opt := range opts {
+		opt(s)
+	}
+
 	return s
 }
 
@@ -125,6 +172,21 @@ func (s *Builder) UnsetNeededFamilies() {
 // SpanFromEncDatums assumes that the EncDatums in values are in the order of the index columns.
 // It also returns whether or not the input values contain a null value or not, which can be
 // used as input for CanSplitSpanIntoSeparateFamilies.
+//
+// SpanFromEncDatums and SpanFromDatumRow intentionally keep returning a
+// single roachpb.Span: their callers (row fetchers, backfillers, etc.) all
+// consume one span per row today, and the multi-key inverted index fan-out
+// added to the optimizer-driven SpansFromConstraint path doesn't apply here
+// -- EncDatums/Datums always name a single index entry, never a composite
+// JSON/array value being looked up by containment.
+//
+// NOTE: this is a deliberate, explicit descope of part of chunk0-1's
+// original ask, which also wanted these two functions extended to return
+// roachpb.Spans for inverted indexes. Doing that properly requires plural
+// sqlbase.MakeSpansFromEncDatums/EncodePartialIndexSpans equivalents of the
+// single-span sqlbase functions called below, which don't exist in this
+// tree and are out of scope for a change confined to this package; adding
+// them is tracked as follow-up work rather than landed here.
 func (s *Builder) SpanFromEncDatums(
 	values sqlbase.EncDatumRow, prefixLen int,
 ) (_ roachpb.Span, containsNull bool, _ error) {
@@ -136,6 +198,9 @@ func (s *Builder) SpanFromEncDatums(
 // SpanFromDatumRow assumes that values is a valid table row for the Builder's table.
 // It also returns whether or not the input values contain a null value or not, which can be
 // used as input for CanSplitSpanIntoSeparateFamilies.
+//
+// See the comment on SpanFromEncDatums for why this keeps returning a single
+// roachpb.Span.
 func (s *Builder) SpanFromDatumRow(
 	values tree.Datums, prefixLen int, colMap map[sqlbase.ColumnID]int,
 ) (_ roachpb.Span, containsNull bool, _ error) {
@@ -191,14 +256,277 @@ func (s *Builder) CanSplitSpanIntoSeparateFamilies(
 		numNeededFamilies < len(s.table.Families)
 }
 
+// SetLocalityFilter configures the Builder to restrict and tag spans
+// generated by MaybeSplitSpanByPartition according to nodeLocality, the
+// locality of the node evaluating the query. Partitions whose zone config
+// has lease preferences, none of which match, are dropped rather than scanned,
+// which lets a locality-optimized search avoid issuing RPCs to remote
+// regions. SetPartitionZoneConfigs must also be called for this to have any
+// effect, since the Builder needs each partition's zone config to know which
+// region it prefers.
+func (s *Builder) SetLocalityFilter(nodeLocality roachpb.Locality) {
+	s.nodeLocality = nodeLocality
+	s.localityFilterSet = true
+}
+
+// UnsetLocalityFilter disables the locality-aware span splitting and
+// filtering configured by SetLocalityFilter.
+func (s *Builder) UnsetLocalityFilter() {
+	s.nodeLocality = roachpb.Locality{}
+	s.localityFilterSet = false
+}
+
+// SetPartitionZoneConfigs supplies the zone config for each partition (and
+// subpartition, keyed by the dot-joined chain of its ancestors' names and its
+// own, e.g. "us.ca") of the Builder's index. It is used
+// together with SetLocalityFilter by MaybeSplitSpanByPartition to decide
+// whether a partition is local to the node evaluating the query.
+func (s *Builder) SetPartitionZoneConfigs(zoneConfigs map[string]*zonepb.ZoneConfig) {
+	s.partitionZoneConfigs = zoneConfigs
+}
+
+// SpanPartition ties a roachpb.Span to the name of the index partition it was
+// generated from. PartitionName is empty when the span was not split by
+// partition (the index isn't partitioned, or the span doesn't reach into the
+// partitioning columns). Callers such as EXPLAIN use
+// the mapping to report which partition(s) a scan will touch.
+type SpanPartition struct {
+	Span          roachpb.Span
+	PartitionName string
+}
+
+// MaybeSplitSpanByPartition splits span, which was generated using prefixLen
+// constrained index columns, at the boundaries of the index's LIST, RANGE,
+// and subpartitions, returning the portions of span that each partition
+// covers, each tagged with that partition's name. A LIST partition yields one
+// SpanPartition per value that span overlaps, a RANGE partition one, and a
+// DEFAULT partition one per gap that its siblings leave in span. Portions of
+// span that no partition covers (a LIST partitioning without a DEFAULT
+// partition, or keys outside every RANGE partition) are not returned.
+// If a locality filter has been configured (see SetLocalityFilter)
+// and zone configs are available (see SetPartitionZoneConfigs), partitions
+// whose zone config's lease preferences don't match nodeLocality are
+// excluded from the result entirely, so a locality-optimized scan never
+// issues RPCs to remote regions.
+//
+// If the index isn't partitioned, or span doesn't reach into the
+// partitioning columns, span is returned unmodified with an empty
+// PartitionName.
+func (s *Builder) MaybeSplitSpanByPartition(
+	appendTo []SpanPartition, span roachpb.Span, prefixLen int,
+) ([]SpanPartition, error) {
+	partitioning := s.index.Partitioning
+	if partitioning.NumColumns == 0 || int(partitioning.NumColumns) > prefixLen {
+		return append(appendTo, SpanPartition{Span: span}), nil
+	}
+	return s.splitSpanByPartitioning(appendTo, span, partitioning, s.KeyPrefix, "")
+}
+
+// splitSpanByPartitioning recursively walks a PartitioningDescriptor (and any
+// subpartitioning), clipping span to the key range that each partition value
+// (or value range) covers so that the returned SpanPartitions are disjoint
+// sub-spans of span rather than span repeated once per partition. prefix is
+// the already-encoded key bytes preceding this partitioning level's columns
+// (the index's key prefix, plus any ancestor partition values). parentName is
+// the dot-joined chain of ancestor partition names, used to form unique keys
+// into s.partitionZoneConfigs for subpartitions.
+func (s *Builder) splitSpanByPartitioning(
+	appendTo []SpanPartition,
+	span roachpb.Span,
+	partitioning sqlbase.PartitioningDescriptor,
+	prefix []byte,
+	parentName string,
+) ([]SpanPartition, error) {
+	qualify := func(name string) string {
+		if parentName == "" {
+			return name
+		}
+		return parentName + "." + name
+	}
+
+	switch {
+	case len(partitioning.List) > 0:
+		// covered tracks every key range claimed by an explicit value of a
+		// sibling partition, so that the DEFAULT partition (if any) only
+		// gets the portion of span that none of its siblings cover.
+		var covered []roachpb.Span
+		var defaultPart *sqlbase.PartitioningDescriptor_List
+		for i := range partitioning.List {
+			part := &partitioning.List[i]
+			if len(part.Values) == 0 {
+				// A LIST partition with no explicit value tuples is the
+				// DEFAULT partition; handle it last, once we know what its
+				// siblings have claimed.
+				defaultPart = part
+				continue
+			}
+			name := qualify(part.Name)
+			local := s.partitionIsLocal(name)
+			for _, value := range part.Values {
+				valueSpan, ok := intersectSpans(span, encodedPrefixSpan(prefix, value))
+				if !ok {
+					continue
+				}
+				covered = append(covered, valueSpan)
+				if !local {
+					continue
+				}
+				var err error
+				appendTo, err = s.splitIntoSubpartitionOrLeaf(
+					appendTo, valueSpan, part.Subpartitioning, append(append([]byte(nil), prefix...), value...), name)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if defaultPart != nil {
+			name := qualify(defaultPart.Name)
+			if s.partitionIsLocal(name) {
+				for _, remainder := range subtractSpans(span, covered) {
+					var err error
+					appendTo, err = s.splitIntoSubpartitionOrLeaf(
+						appendTo, remainder, defaultPart.Subpartitioning, prefix, name)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		return appendTo, nil
+	case len(partitioning.Range) > 0:
+		for i := range partitioning.Range {
+			part := &partitioning.Range[i]
+			name := qualify(part.Name)
+			if !s.partitionIsLocal(name) {
+				continue
+			}
+			rangeSpan := roachpb.Span{
+				Key:    append(append(roachpb.Key(nil), prefix...), part.FromInclusive...),
+				EndKey: append(append(roachpb.Key(nil), prefix...), part.ToExclusive...),
+			}
+			clipped, ok := intersectSpans(span, rangeSpan)
+			if !ok {
+				continue
+			}
+			appendTo = append(appendTo, SpanPartition{Span: clipped, PartitionName: name})
+		}
+		return appendTo, nil
+	default:
+		return append(appendTo, SpanPartition{Span: span, PartitionName: parentName}), nil
+	}
+}
+
+// splitIntoSubpartitionOrLeaf recurses into subpartitioning if the partition
+// that produced valueSpan has any, otherwise appends valueSpan as a leaf
+// SpanPartition tagged with name.
+func (s *Builder) splitIntoSubpartitionOrLeaf(
+	appendTo []SpanPartition,
+	valueSpan roachpb.Span,
+	subpartitioning sqlbase.PartitioningDescriptor,
+	prefix []byte,
+	name string,
+) ([]SpanPartition, error) {
+	if len(subpartitioning.List) > 0 || len(subpartitioning.Range) > 0 {
+		return s.splitSpanByPartitioning(appendTo, valueSpan, subpartitioning, prefix, name)
+	}
+	return append(appendTo, SpanPartition{Span: valueSpan, PartitionName: name}), nil
+}
+
+// encodedPrefixSpan returns the key range covering every key that starts
+// with prefix followed by value, i.e. every row whose partitioning columns
+// at this level encode to value.
+func encodedPrefixSpan(prefix, value []byte) roachpb.Span {
+	key := append(append(roachpb.Key(nil), prefix...), value...)
+	return roachpb.Span{Key: key, EndKey: key.PrefixEnd()}
+}
+
+// intersectSpans clips a to the portion that also falls within b, returning
+// ok=false if they don't overlap at all.
+func intersectSpans(a, b roachpb.Span) (_ roachpb.Span, ok bool) {
+	key := a.Key
+	if bytes.Compare(b.Key, key) > 0 {
+		key = b.Key
+	}
+	endKey := a.EndKey
+	if bytes.Compare(b.EndKey, endKey) < 0 {
+		endKey = b.EndKey
+	}
+	if bytes.Compare(key, endKey) >= 0 {
+		return roachpb.Span{}, false
+	}
+	return roachpb.Span{Key: key, EndKey: endKey}, true
+}
+
+// subtractSpans returns the portions of total not covered by any span in
+// covered. covered need not be sorted, but every entry must be a subset of
+// total.
+func subtractSpans(total roachpb.Span, covered []roachpb.Span) []roachpb.Span {
+	sort.Slice(covered, func(i, j int) bool {
+		return bytes.Compare(covered[i].Key, covered[j].Key) < 0
+	})
+	var gaps []roachpb.Span
+	cursor := total.Key
+	for _, c := range covered {
+		if bytes.Compare(c.Key, cursor) > 0 {
+			gaps = append(gaps, roachpb.Span{Key: cursor, EndKey: c.Key})
+		}
+		if bytes.Compare(c.EndKey, cursor) > 0 {
+			cursor = c.EndKey
+		}
+	}
+	if bytes.Compare(cursor, total.EndKey) < 0 {
+		gaps = append(gaps, roachpb.Span{Key: cursor, EndKey: total.EndKey})
+	}
+	return gaps
+}
+
+// partitionIsLocal returns whether the named partition should be included in
+// a locality-aware scan. It's always true unless SetLocalityFilter and
+// SetPartitionZoneConfigs have both configured the Builder with enough
+// information to know the partition prefers a different region: in that
+// case, the partition is local only if, for one of its zone config's lease
+// preferences, s.nodeLocality has a tier matching the key and value of every
+// constraint of that preference.
+func (s *Builder) partitionIsLocal(partitionName string) bool {
+	if !s.localityFilterSet || s.partitionZoneConfigs == nil {
+		return true
+	}
+	zc, ok := s.partitionZoneConfigs[partitionName]
+	if !ok || len(zc.LeasePreferences) == 0 {
+		return true
+	}
+	for _, pref := range zc.LeasePreferences {
+		matches := true
+		for _, c := range pref.Constraints {
+			if v, ok := s.nodeLocality.Find(c.Key); !ok || v != c.Value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
 // Functions for optimizer related span generation are below.
 
 // SpansFromConstraint generates spans from an optimizer constraint.
 // TODO (rohany): In future work, there should be a single API to generate spans
 //  from constraints, datums and encdatums.
+//
+// If the Builder's index is hash-sharded and the constraint doesn't mention
+// the shard column (the common case, since the shard value can't usually be
+// derived by the optimizer), the spans are fanned out across the index's
+// shard buckets: see spansFromConstraintSharded.
 func (s *Builder) SpansFromConstraint(
 	c *constraint.Constraint, needed exec.TableColumnOrdinalSet, forDelete bool,
 ) (roachpb.Spans, error) {
+	if s.shardBucketCount > 0 {
+		return s.spansFromConstraintSharded(c, needed, forDelete)
+	}
+
 	var spans roachpb.Spans
 	var err error
 	if c == nil || c.IsUnconstrained() {
@@ -220,6 +548,140 @@ func (s *Builder) SpansFromConstraint(
 	return spans, nil
 }
 
+// spansFromConstraintSharded implements SpansFromConstraint for a
+// hash-sharded index. c is expected to constrain the index's user-visible
+// columns only, i.e. it has no knowledge of the leading shard column. For
+// each constraint span, the Builder either:
+//   - computes the single shard bucket that the constrained prefix hashes to,
+//     when every column covered by the index is pinned to an exact value, or
+//   - enumerates all BucketCount buckets, when the span covers a range over
+//     those columns and so the shard value can't be determined in advance.
+//
+// The resulting roachpb.Spans have the bucket's encoded shard value prepended
+// to each one, so that a DistSQL scanner can execute the (up to BucketCount)
+// spans in parallel instead of degenerating to a full index scan.
+func (s *Builder) spansFromConstraintSharded(
+	c *constraint.Constraint, needed exec.TableColumnOrdinalSet, forDelete bool,
+) (roachpb.Spans, error) {
+	appendShardedSpans := func(spans roachpb.Spans, cs *constraint.Span) (roachpb.Spans, error) {
+		// shardColOffset of 1 shifts every column lookup (interstices, column
+		// directions) past the leading shard column, since cs is expressed
+		// purely in terms of the index's user-visible columns.
+		suffixSpans, err := s.appendSpansFromConstraintSpanWithOffset(nil, cs, exec.TableColumnOrdinalSet{}, forDelete, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		buckets, err := s.shardBucketsForConstraintSpan(cs)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, bucket := range buckets {
+			shardKey := encodeShardValue(s.interstices[0], bucket)
+			for _, sp := range suffixSpans {
+				spans = append(spans, roachpb.Span{
+					Key:    append(append(roachpb.Key(nil), shardKey...), sp.Key...),
+					EndKey: append(append(roachpb.Key(nil), shardKey...), sp.EndKey...),
+				})
+			}
+		}
+		return spans, nil
+	}
+
+	if c == nil || c.IsUnconstrained() {
+		return appendShardedSpans(nil, &constraint.UnconstrainedSpan)
+	}
+
+	var spans roachpb.Spans
+	var err error
+	for i := 0; i < c.Spans.Count(); i++ {
+		spans, err = appendShardedSpans(spans, c.Spans.Get(i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return spans, nil
+}
+
+// shardBucketsForConstraintSpan determines which shard bucket(s) a
+// constraint span could fall into. If cs pins every column of the index
+// (other than the shard column) to an exact value, there is exactly one
+// possible bucket and it's computed by hashing those values; otherwise every
+// bucket must be scanned.
+func (s *Builder) shardBucketsForConstraintSpan(cs *constraint.Span) ([]int32, error) {
+	// The shard column occupies position 0, so the user-visible columns that
+	// this constraint can pin down are positions 1 through len(ColumnDirections)-1.
+	numShardedCols := len(s.index.ColumnDirections) - 1
+	isPoint := cs.StartKey().Length() == cs.EndKey().Length() &&
+		cs.StartKey().Length() == numShardedCols &&
+		cs.StartBoundary() == constraint.IncludeBoundary &&
+		cs.EndBoundary() == constraint.IncludeBoundary
+	if isPoint {
+		for i := 0; i < cs.StartKey().Length(); i++ {
+			if cs.StartKey().Value(i).Compare(nil, cs.EndKey().Value(i)) != 0 {
+				isPoint = false
+				break
+			}
+		}
+	}
+	if !isPoint {
+		buckets := make([]int32, s.shardBucketCount)
+		for i := range buckets {
+			buckets[i] = int32(i)
+		}
+		return buckets, nil
+	}
+
+	valueBytes, err := s.encodeShardColumnValues(cs.StartKey())
+	if err != nil {
+		return nil, err
+	}
+	return []int32{hashedShardBucket(s.shardBucketCount, valueBytes)}, nil
+}
+
+// encodeShardColumnValues encodes ck's values the way the hash-sharded
+// index's computed shard column expression -- mod(fnv32(crdb_internal.
+// datums_to_bytes(cols...)), buckets) -- sees them: as a sequence of
+// value-encoded datums, independent of index column direction. This is
+// deliberately distinct from encodeConstraintKeyWithOffset, which produces
+// direction-aware, type-tag-free key encodings meant for ordered scans --
+// those bytes aren't the bytes that were hashed to produce the persisted
+// shard value, so hashing them would pick the wrong bucket for real rows.
+func (s *Builder) encodeShardColumnValues(ck constraint.Key) ([]byte, error) {
+	var buf []byte
+	for i := 0; i < ck.Length(); i++ {
+		colID := s.index.ColumnIDs[0]
+		if i+1 < len(s.index.ColumnIDs) {
+			colID = s.index.ColumnIDs[i+1]
+		}
+		var err error
+		buf, err = sqlbase.EncodeTableValue(buf, colID, ck.Value(i), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// encodeShardValue encodes a shard bucket number the same way a stored
+// hash-sharded index entry would, inserting interstice (the separator that
+// belongs before the shard column, usually just the index's KeyPrefix)
+// beforehand.
+func encodeShardValue(interstice []byte, bucket int32) roachpb.Key {
+	key := append(roachpb.Key(nil), interstice...)
+	return encoding.EncodeVarintAscending(key, int64(bucket))
+}
+
+// hashedShardBucket hashes encoded using the same fnv32-based hash that the
+// `fnv32` builtin (used in a hash-sharded index's computed shard column
+// expression) would, and reduces it into [0, buckets).
+func hashedShardBucket(buckets int32, encoded []byte) int32 {
+	h := fnv.New32()
+	_, _ = h.Write(encoded)
+	return int32(h.Sum32() % uint32(buckets))
+}
+
 // UnconstrainedSpans returns the full span corresponding to the Builder's
 // table and index.
 func (s *Builder) UnconstrainedSpans(forDelete bool) (roachpb.Spans, error) {
@@ -229,97 +691,188 @@ func (s *Builder) UnconstrainedSpans(forDelete bool) (roachpb.Spans, error) {
 // appendSpansFromConstraintSpan converts a constraint.Span to one or more
 // roachpb.Spans and appends them to the provided spans. It appends multiple
 // spans in the case that multiple, non-adjacent column families should be
-// scanned. The forDelete parameter indicates whether these spans will be used
-// for row deletion.
+// scanned, or in the case that the span is against an inverted index and the
+// constrained value (e.g. a JSON object with several paths, or a multi-element
+// array) encodes to more than one inverted key. The forDelete parameter
+// indicates whether these spans will be used for row deletion.
 func (s *Builder) appendSpansFromConstraintSpan(
 	appendTo roachpb.Spans, cs *constraint.Span, needed exec.TableColumnOrdinalSet, forDelete bool,
 ) (roachpb.Spans, error) {
-	var span roachpb.Span
-	var err error
-	var containsNull bool
-	// Encode each logical part of the start key.
-	span.Key, containsNull, err = s.encodeConstraintKey(cs.StartKey())
+	return s.appendSpansFromConstraintSpanWithOffset(appendTo, cs, needed, forDelete, 0)
+}
+
+// appendSpansFromConstraintSpanWithOffset is appendSpansFromConstraintSpan,
+// but every logical column position is shifted by colOffset before it is
+// used to index into s.interstices or s.index.ColumnDirections. It's used by
+// spansFromConstraintSharded to encode the part of a hash-sharded index's key
+// that comes after the (unconstrained) shard column, which cs numbers
+// starting from 0 even though it really starts at index column 1.
+func (s *Builder) appendSpansFromConstraintSpanWithOffset(
+	appendTo roachpb.Spans,
+	cs *constraint.Span,
+	needed exec.TableColumnOrdinalSet,
+	forDelete bool,
+	colOffset int,
+) (roachpb.Spans, error) {
+	// Encode each logical part of the start and end keys. Each of these can
+	// fan out into multiple keys if the span is against an inverted index.
+	startKeys, containsNull, err := s.encodeConstraintKeyWithOffset(cs.StartKey(), colOffset)
 	if err != nil {
 		return nil, err
 	}
-	if cs.StartBoundary() == constraint.IncludeBoundary {
-		span.Key = append(span.Key, s.interstices[cs.StartKey().Length()]...)
-	} else {
-		// We need to exclude the value this logical part refers to.
-		span.Key = span.Key.PrefixEnd()
-	}
-	// Encode each logical part of the end key.
-	span.EndKey, _, err = s.encodeConstraintKey(cs.EndKey())
+	endKeys, _, err := s.encodeConstraintKeyWithOffset(cs.EndKey(), colOffset)
 	if err != nil {
 		return nil, err
 	}
-	span.EndKey = append(span.EndKey, s.interstices[cs.EndKey().Length()]...)
+	if len(startKeys) != len(endKeys) {
+		// This can only happen if the inverted column produced a different
+		// number of keys on the start and end side of the span, which isn't
+		// possible since both sides encode the same (single) inverted value.
+		return nil, errors.AssertionFailedf(
+			"expected the same number of start and end keys, got %d and %d",
+			len(startKeys), len(endKeys))
+	}
+
+	startInterstice := s.interstices[cs.StartKey().Length()+colOffset]
+	endInterstice := s.interstices[cs.EndKey().Length()+colOffset]
+	fannedOut := make(roachpb.Spans, 0, len(startKeys))
+	for i := range startKeys {
+		var span roachpb.Span
+		if cs.StartBoundary() == constraint.IncludeBoundary {
+			span.Key = append(startKeys[i], startInterstice...)
+		} else {
+			// We need to exclude the value this logical part refers to.
+			span.Key = startKeys[i].PrefixEnd()
+		}
+		span.EndKey = append(endKeys[i], endInterstice...)
+
+		// Optimization: for single row lookups on a table with multiple column
+		// families, only scan the relevant column families. This is disabled for
+		// deletions to ensure that the entire row is deleted, and for any
+		// shifted (shard-suffix) encoding, since the family split logic assumes
+		// prefixLen is counted from the start of the index.
+		if colOffset == 0 && !forDelete && needed.Len() > 0 && span.Key.Equal(span.EndKey) {
+			neededFamilyIDs := sqlbase.NeededColumnFamilyIDs(needed, s.table, s.index)
+			if s.CanSplitSpanIntoSeparateFamilies(len(neededFamilyIDs), cs.StartKey().Length(), containsNull) {
+				fannedOut = sqlbase.SplitSpanIntoSeparateFamilies(fannedOut, span, neededFamilyIDs)
+				continue
+			}
+		}
 
-	// Optimization: for single row lookups on a table with multiple column
-	// families, only scan the relevant column families. This is disabled for
-	// deletions to ensure that the entire row is deleted.
-	if !forDelete && needed.Len() > 0 && span.Key.Equal(span.EndKey) {
-		neededFamilyIDs := sqlbase.NeededColumnFamilyIDs(needed, s.table, s.index)
-		if s.CanSplitSpanIntoSeparateFamilies(len(neededFamilyIDs), cs.StartKey().Length(), containsNull) {
-			return sqlbase.SplitSpanIntoSeparateFamilies(appendTo, span, neededFamilyIDs), nil
+		// We tighten the end key to prevent reading interleaved children after
+		// the last parent key. If cs.End.Inclusive is true, we also advance the
+		// key as necessary.
+		endInclusive := cs.EndBoundary() == constraint.IncludeBoundary
+		span.EndKey, err = sqlbase.AdjustEndKeyForInterleave(s.table, s.index, span.EndKey, endInclusive)
+		if err != nil {
+			return nil, err
 		}
+		fannedOut = append(fannedOut, span)
 	}
 
-	// We tighten the end key to prevent reading interleaved children after the
-	// last parent key. If cs.End.Inclusive is true, we also advance the key as
-	// necessary.
-	endInclusive := cs.EndBoundary() == constraint.IncludeBoundary
-	span.EndKey, err = sqlbase.AdjustEndKeyForInterleave(s.table, s.index, span.EndKey, endInclusive)
-	if err != nil {
-		return nil, err
+	// A composite inverted value (e.g. a JSON object with multiple paths, or
+	// an array with multiple elements) can produce spans that overlap with
+	// each other, so they must be de-duplicated and merged before being
+	// handed back to the caller.
+	if len(startKeys) > 1 {
+		fannedOut = mergeOverlappingSpans(fannedOut)
+	}
+	return append(appendTo, fannedOut...), nil
+}
+
+// mergeOverlappingSpans sorts spans and merges any that overlap or are
+// adjacent, returning a de-duplicated, non-overlapping result. It is used to
+// collapse the multiple spans that a single constraint span can produce when
+// the constrained value is an inverted index key that fans out to more than
+// one encoded key.
+func mergeOverlappingSpans(spans roachpb.Spans) roachpb.Spans {
+	sort.Slice(spans, func(i, j int) bool {
+		return bytes.Compare(spans[i].Key, spans[j].Key) < 0
+	})
+	merged := spans[:1]
+	for _, sp := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if bytes.Compare(sp.Key, last.EndKey) <= 0 {
+			if bytes.Compare(sp.EndKey, last.EndKey) > 0 {
+				last.EndKey = sp.EndKey
+			}
+			continue
+		}
+		merged = append(merged, sp)
 	}
-	return append(appendTo, span), nil
+	return merged
 }
 
-// encodeConstraintKey encodes each logical part of a constraint.Key into a
-// roachpb.Key; interstices[i] is inserted before the i-th value.
+// encodeConstraintKey encodes each logical part of a constraint.Key into one
+// or more roachpb.Keys; interstices[i] is inserted before the i-th value. A
+// logical part normally encodes to exactly one key, but when it is encoded
+// against an inverted index column, EncodeInvertedIndexTableKeys can return
+// several keys for a single value (e.g. a JSON object has one inverted key
+// per path, and an array has one inverted key per element); in that case
+// every key returned here must be carried through as a separate candidate
+// key by the caller. The inverted column, when present, must be the last
+// logical part of the key, since there is nothing meaningful to encode after
+// an inverted key.
 func (s *Builder) encodeConstraintKey(
 	ck constraint.Key,
-) (_ roachpb.Key, containsNull bool, _ error) {
-	var key []byte
+) (_ []roachpb.Key, containsNull bool, _ error) {
+	return s.encodeConstraintKeyWithOffset(ck, 0)
+}
+
+// encodeConstraintKeyWithOffset is encodeConstraintKey, but every logical
+// column position i is looked up as i+colOffset in s.interstices and
+// s.index.ColumnDirections. See the comment on
+// appendSpansFromConstraintSpanWithOffset for why this is needed.
+func (s *Builder) encodeConstraintKeyWithOffset(
+	ck constraint.Key, colOffset int,
+) (_ []roachpb.Key, containsNull bool, _ error) {
+	keys := []roachpb.Key{nil}
 	for i := 0; i < ck.Length(); i++ {
 		val := ck.Value(i)
 		if val == tree.DNull {
 			containsNull = true
 		}
-		key = append(key, s.interstices[i]...)
+		interstice := s.interstices[i+colOffset]
 
-		var err error
 		// For extra columns (like implicit columns), the direction
 		// is ascending.
 		dir := encoding.Ascending
-		if i < len(s.index.ColumnDirections) {
-			dir, err = s.index.ColumnDirections[i].ToEncodingDirection()
+		if i+colOffset < len(s.index.ColumnDirections) {
+			var err error
+			dir, err = s.index.ColumnDirections[i+colOffset].ToEncodingDirection()
 			if err != nil {
 				return nil, false, err
 			}
 		}
 
 		if s.index.Type == sqlbase.IndexDescriptor_INVERTED {
-			keys, err := sqlbase.EncodeInvertedIndexTableKeys(val, key)
-			if err != nil {
-				return nil, false, err
+			if i != ck.Length()-1 {
+				return nil, false, errors.AssertionFailedf(
+					"the inverted column must be the last column in the constraint key")
 			}
-			if len(keys) == 0 {
-				err := errors.AssertionFailedf("trying to use null key in index lookup")
-				return nil, false, err
+			fannedOut := make([]roachpb.Key, 0, len(keys))
+			for _, key := range keys {
+				key = append(key, interstice...)
+				invKeys, err := sqlbase.EncodeInvertedIndexTableKeys(val, key)
+				if err != nil {
+					return nil, false, err
+				}
+				if len(invKeys) == 0 {
+					return nil, false, errors.AssertionFailedf("trying to use null key in index lookup")
+				}
+				fannedOut = append(fannedOut, invKeys...)
 			}
-			if len(keys) > 1 {
-				err := errors.AssertionFailedf("trying to use multiple keys in index lookup")
-				return nil, false, err
-			}
-			key = keys[0]
+			keys = fannedOut
 		} else {
-			key, err = sqlbase.EncodeTableKey(key, val, dir)
-			if err != nil {
-				return nil, false, err
+			for j, key := range keys {
+				key = append(key, interstice...)
+				key, err := sqlbase.EncodeTableKey(key, val, dir)
+				if err != nil {
+					return nil, false, err
+				}
+				keys[j] = key
 			}
 		}
 	}
-	return key, containsNull, nil
+	return keys, containsNull, nil
 }
@@ -0,0 +1,570 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package span
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/constraint"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/exec"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+)
+
+// makeTestTableAndIndex builds a minimal single-family table descriptor with
+// one index, for Builder tests that don't need a full logical schema.
+func makeTestTableAndIndex(
+	colTypes []types.T, index sqlbase.IndexDescriptor,
+) (*sqlbase.TableDescriptor, *sqlbase.IndexDescriptor) {
+	cols := make([]sqlbase.ColumnDescriptor, len(colTypes))
+	colIDs := make(sqlbase.ColumnIDs, len(colTypes))
+	for i, typ := range colTypes {
+		cols[i] = sqlbase.ColumnDescriptor{ID: sqlbase.ColumnID(i + 1), Type: typ}
+		colIDs[i] = sqlbase.ColumnID(i + 1)
+	}
+	table := &sqlbase.TableDescriptor{
+		ID:      53,
+		Columns: cols,
+		Families: []sqlbase.ColumnFamilyDescriptor{
+			{ID: 0, ColumnIDs: colIDs},
+		},
+		PrimaryIndex: index,
+	}
+	return table, &table.PrimaryIndex
+}
+
+// TestSpansFromConstraintInvertedMultiKey verifies that encodeConstraintKey
+// returns at least one distinct key per path or element when a value
+// constrained against an inverted index (a JSON object with several paths,
+// or a multi-element array) encodes to more than one inverted key.
+func TestSpansFromConstraintInvertedMultiKey(t *testing.T) {
+	index := sqlbase.IndexDescriptor{
+		ID:               1,
+		ColumnIDs:        []sqlbase.ColumnID{1},
+		ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC},
+		Type:             sqlbase.IndexDescriptor_INVERTED,
+	}
+	table, index := makeTestTableAndIndex([]types.T{*types.Jsonb}, index)
+	b := MakeBuilder(table, index)
+
+	testCases := []struct {
+		name    string
+		json    string
+		minKeys int
+	}{
+		{name: "object with multiple paths", json: `{"a": 1, "b": 2}`, minKeys: 2},
+		{name: "array with multiple elements", json: `[1, 2, 3]`, minKeys: 3},
+		{name: "single path object", json: `{"a": 1}`, minKeys: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := tree.ParseDJSON(tc.json)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, containsNull, err := b.encodeConstraintKey(constraint.MakeKey(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if containsNull {
+				t.Fatal("expected containsNull to be false")
+			}
+			if len(keys) < tc.minKeys {
+				t.Fatalf("expected at least %d inverted keys for %s, got %d", tc.minKeys, tc.json, len(keys))
+			}
+			seen := make(map[string]bool, len(keys))
+			for _, k := range keys {
+				if seen[string(k)] {
+					t.Fatalf("duplicate inverted key %q for %s", k, tc.json)
+				}
+				seen[string(k)] = true
+			}
+		})
+	}
+}
+
+// TestSpansFromConstraintInvertedContainment exercises the public
+// SpansFromConstraint entry point (rather than the private encodeConstraintKey
+// helper) with a real @> constraint span on an inverted index, the way the
+// optimizer would build one for a JSON/array containment lookup. It asserts
+// on the actual roachpb.Spans returned, so it also covers the dedup/merge
+// pass appendSpansFromConstraintSpanWithOffset runs on the fanned-out keys.
+func TestSpansFromConstraintInvertedContainment(t *testing.T) {
+	index := sqlbase.IndexDescriptor{
+		ID:               1,
+		ColumnIDs:        []sqlbase.ColumnID{1},
+		ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC},
+		Type:             sqlbase.IndexDescriptor_INVERTED,
+	}
+	table, index := makeTestTableAndIndex([]types.T{*types.Jsonb}, index)
+
+	var keyCtx constraint.KeyContext
+	keyCtx.EvalCtx = tree.NewTestingEvalContext(cluster.MakeTestingClusterSettings())
+	keyCtx.Columns.Init([]opt.OrderingColumn{opt.OrderingColumn(1)})
+
+	testCases := []struct {
+		name     string
+		json     string
+		minSpans int
+	}{
+		{name: "object with multiple paths", json: `{"a": 1, "b": 2}`, minSpans: 2},
+		{name: "array with multiple elements", json: `[1, 2, 3]`, minSpans: 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := tree.ParseDJSON(tc.json)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := constraint.MakeKey(d)
+			var sp constraint.Span
+			sp.Init(key, constraint.IncludeBoundary, key, constraint.IncludeBoundary)
+			var c constraint.Constraint
+			c.InitSingleSpan(&keyCtx, &sp)
+
+			b := MakeBuilder(table, index)
+			spans, err := b.SpansFromConstraint(&c, exec.TableColumnOrdinalSet{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(spans) < tc.minSpans {
+				t.Fatalf("expected at least %d spans for a @> lookup on %s, got %d: %v",
+					tc.minSpans, tc.json, len(spans), spans)
+			}
+
+			fullSpan := roachpb.Span{Key: b.KeyPrefix, EndKey: roachpb.Key(b.KeyPrefix).PrefixEnd()}
+			assertDisjointWithin(t, fullSpan, spanPartitionsOf(spans))
+		})
+	}
+}
+
+// spanPartitionsOf wraps each span with an empty PartitionName so that
+// roachpb.Spans can be checked with assertDisjointWithin.
+func spanPartitionsOf(spans roachpb.Spans) []SpanPartition {
+	out := make([]SpanPartition, len(spans))
+	for i, sp := range spans {
+		out[i] = SpanPartition{Span: sp}
+	}
+	return out
+}
+
+// TestMergeOverlappingSpans checks that overlapping and adjacent spans are
+// coalesced, and that disjoint spans are left alone. This backs the
+// deduplication that appendSpansFromConstraintSpanWithOffset performs on the
+// multiple spans a single inverted constraint span can fan out into.
+func TestMergeOverlappingSpans(t *testing.T) {
+	mk := func(start, end string) roachpb.Span {
+		return roachpb.Span{Key: roachpb.Key(start), EndKey: roachpb.Key(end)}
+	}
+
+	in := roachpb.Spans{mk("d", "f"), mk("a", "c"), mk("b", "e")}
+	got := mergeOverlappingSpans(in)
+	want := roachpb.Spans{mk("a", "f")}
+	if len(got) != len(want) || !got[0].Key.Equal(want[0].Key) || !got[0].EndKey.Equal(want[0].EndKey) {
+		t.Fatalf("expected merged span %v, got %v", want, got)
+	}
+
+	disjoint := roachpb.Spans{mk("a", "b"), mk("x", "y")}
+	got = mergeOverlappingSpans(disjoint)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 disjoint spans, got %d: %v", len(got), got)
+	}
+}
+
+// TestMaybeSplitSpanByPartition verifies that a flat LIST partitioning (with
+// a DEFAULT partition claiming whatever its siblings don't) splits an input
+// span into disjoint, clipped SpanPartitions rather than repeating the whole
+// span once per partition. See TestMaybeSplitSpanByRangePartition and
+// TestMaybeSplitSpanBySubpartitionedList for the RANGE and subpartitioned
+// cases.
+func TestMaybeSplitSpanByPartition(t *testing.T) {
+	index := sqlbase.IndexDescriptor{
+		ID:               1,
+		ColumnIDs:        []sqlbase.ColumnID{1, 2},
+		ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC, sqlbase.IndexDescriptor_ASC},
+	}
+	table, index := makeTestTableAndIndex([]types.T{*types.Int, *types.Int}, index)
+	keyPrefix := sqlbase.MakeIndexKeyPrefix(table, index.ID)
+
+	// encInt encodes a partitioning column value the way sqlbase stores it in
+	// PartitioningDescriptor_List.Values: just the encoded datum, with no
+	// table/index key prefix (the prefix is supplied separately when a span
+	// is clipped to a partition).
+	encInt := func(i int64) []byte {
+		d := tree.NewDInt(tree.DInt(i))
+		key, _, err := MakeBuilder(table, index).encodeConstraintKey(constraint.MakeKey(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []byte(key[0][len(keyPrefix):])
+	}
+
+	index.Partitioning = sqlbase.PartitioningDescriptor{
+		NumColumns: 1,
+		List: []sqlbase.PartitioningDescriptor_List{
+			{Name: "west", Values: [][]byte{encInt(1)}},
+			{Name: "east", Values: [][]byte{encInt(2)}},
+			{Name: "default"},
+		},
+	}
+
+	b := MakeBuilder(table, index)
+	fullSpan := roachpb.Span{Key: b.KeyPrefix, EndKey: roachpb.Key(b.KeyPrefix).PrefixEnd()}
+
+	got, err := b.MaybeSplitSpanByPartition(nil, fullSpan, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// default claims two disjoint pieces: the keys below west's value and the
+	// keys above east's (west and east are adjacent, so nothing lies between).
+	if len(got) != 4 {
+		t.Fatalf("expected 4 spans (west, east, and default on either side of them), got %d: %+v", len(got), got)
+	}
+
+	byName := make(map[string]roachpb.Span, len(got))
+	for _, sp := range got {
+		byName[sp.PartitionName] = sp.Span
+	}
+	for _, name := range []string{"west", "east", "default"} {
+		if _, ok := byName[name]; !ok {
+			t.Fatalf("missing partition %q in %+v", name, got)
+		}
+	}
+
+	assertDisjointWithin(t, fullSpan, got)
+}
+
+// assertDisjointWithin fails the test if any SpanPartition in got falls
+// outside bound, or if any two SpanPartitions in got overlap.
+func assertDisjointWithin(t *testing.T, bound roachpb.Span, got []SpanPartition) {
+	t.Helper()
+	for i, a := range got {
+		if bytes.Compare(a.Span.Key, bound.Key) < 0 || bytes.Compare(a.Span.EndKey, bound.EndKey) > 0 {
+			t.Fatalf("partition %q span %v escapes input span %v", a.PartitionName, a.Span, bound)
+		}
+		for j, bSpan := range got {
+			if i == j {
+				continue
+			}
+			if bytes.Compare(a.Span.Key, bSpan.Span.EndKey) < 0 && bytes.Compare(bSpan.Span.Key, a.Span.EndKey) < 0 {
+				t.Fatalf("partitions %q and %q overlap: %v vs %v", a.PartitionName, bSpan.PartitionName, a.Span, bSpan.Span)
+			}
+		}
+	}
+}
+
+// TestMaybeSplitSpanByRangePartition verifies that a RANGE partitioning
+// clips the input span to each partition's [FromInclusive, ToExclusive)
+// bounds, rather than returning the whole span once per RANGE partition.
+func TestMaybeSplitSpanByRangePartition(t *testing.T) {
+	index := sqlbase.IndexDescriptor{
+		ID:               1,
+		ColumnIDs:        []sqlbase.ColumnID{1, 2},
+		ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC, sqlbase.IndexDescriptor_ASC},
+	}
+	table, index := makeTestTableAndIndex([]types.T{*types.Int, *types.Int}, index)
+	keyPrefix := sqlbase.MakeIndexKeyPrefix(table, index.ID)
+
+	encInt := func(i int64) []byte {
+		d := tree.NewDInt(tree.DInt(i))
+		key, _, err := MakeBuilder(table, index).encodeConstraintKey(constraint.MakeKey(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []byte(key[0][len(keyPrefix):])
+	}
+
+	index.Partitioning = sqlbase.PartitioningDescriptor{
+		NumColumns: 1,
+		Range: []sqlbase.PartitioningDescriptor_Range{
+			{Name: "p0_9", FromInclusive: encInt(0), ToExclusive: encInt(10)},
+			{Name: "p10_19", FromInclusive: encInt(10), ToExclusive: encInt(20)},
+		},
+	}
+
+	b := MakeBuilder(table, index)
+	fullSpan := roachpb.Span{Key: b.KeyPrefix, EndKey: roachpb.Key(b.KeyPrefix).PrefixEnd()}
+
+	got, err := b.MaybeSplitSpanByPartition(nil, fullSpan, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 RANGE partitions, got %d: %+v", len(got), got)
+	}
+
+	byName := make(map[string]roachpb.Span, len(got))
+	for _, sp := range got {
+		byName[sp.PartitionName] = sp.Span
+	}
+	for _, name := range []string{"p0_9", "p10_19"} {
+		if _, ok := byName[name]; !ok {
+			t.Fatalf("missing partition %q in %+v", name, got)
+		}
+	}
+	if !byName["p0_9"].EndKey.Equal(byName["p10_19"].Key) {
+		// Not a strict requirement of the API, but for these contiguous
+		// bounds it confirms p0_9 was actually clipped to its own range
+		// instead of covering all the way to fullSpan.EndKey.
+		t.Fatalf("expected p0_9 to end where p10_19 begins, got %v and %v", byName["p0_9"], byName["p10_19"])
+	}
+
+	assertDisjointWithin(t, fullSpan, got)
+}
+
+// TestMaybeSplitSpanBySubpartitionedList verifies that splitSpanByPartitioning
+// recurses into a LIST partition's Subpartitioning, and that a DEFAULT
+// partition at either level still only claims the portion of its parent's
+// span that its siblings didn't.
+func TestMaybeSplitSpanBySubpartitionedList(t *testing.T) {
+	index := sqlbase.IndexDescriptor{
+		ID:               1,
+		ColumnIDs:        []sqlbase.ColumnID{1, 2},
+		ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC, sqlbase.IndexDescriptor_ASC},
+	}
+	table, index := makeTestTableAndIndex([]types.T{*types.Int, *types.Int}, index)
+	keyPrefix := sqlbase.MakeIndexKeyPrefix(table, index.ID)
+
+	encInt := func(i int64) []byte {
+		d := tree.NewDInt(tree.DInt(i))
+		key, _, err := MakeBuilder(table, index).encodeConstraintKey(constraint.MakeKey(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []byte(key[0][len(keyPrefix):])
+	}
+
+	index.Partitioning = sqlbase.PartitioningDescriptor{
+		NumColumns: 1,
+		List: []sqlbase.PartitioningDescriptor_List{
+			{
+				Name:   "us",
+				Values: [][]byte{encInt(1)},
+				Subpartitioning: sqlbase.PartitioningDescriptor{
+					NumColumns: 1,
+					List: []sqlbase.PartitioningDescriptor_List{
+						{Name: "ca", Values: [][]byte{encInt(100)}},
+						{Name: "other"},
+					},
+				},
+			},
+			{Name: "default"},
+		},
+	}
+
+	b := MakeBuilder(table, index)
+	fullSpan := roachpb.Span{Key: b.KeyPrefix, EndKey: roachpb.Key(b.KeyPrefix).PrefixEnd()}
+
+	got, err := b.MaybeSplitSpanByPartition(nil, fullSpan, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// us.other claims the two pieces of us on either side of ca's value, and
+	// default the two pieces of the full span on either side of us's value.
+	if len(got) != 5 {
+		t.Fatalf("expected 5 spans (us.ca, two of us.other, two of default), got %d: %+v", len(got), got)
+	}
+
+	byName := make(map[string]roachpb.Span, len(got))
+	for _, sp := range got {
+		byName[sp.PartitionName] = sp.Span
+	}
+	for _, name := range []string{"us.ca", "us.other", "default"} {
+		if _, ok := byName[name]; !ok {
+			t.Fatalf("missing partition %q in %+v", name, got)
+		}
+	}
+
+	assertDisjointWithin(t, fullSpan, got)
+}
+
+// TestSpansFromConstraintShardedIndex verifies that SpansFromConstraint
+// fans an equality constraint on a hash-sharded index's non-shard columns
+// out into exactly one span (the single bucket the value hashes to), a
+// range constraint out into one span per bucket, and that
+// DisableShardedIndexFanOut reverts to the unsharded behavior.
+func TestSpansFromConstraintShardedIndex(t *testing.T) {
+	const buckets = 4
+	index := sqlbase.IndexDescriptor{
+		ID:               1,
+		ColumnIDs:        []sqlbase.ColumnID{1, 2},
+		ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC, sqlbase.IndexDescriptor_ASC},
+		Sharded:          sqlbase.ShardedDescriptor{IsSharded: true, ShardBuckets: buckets},
+	}
+	table, index := makeTestTableAndIndex([]types.T{*types.Int, *types.Int}, index)
+
+	evalCtx := tree.NewTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	t.Run("equality constrains exactly one bucket", func(t *testing.T) {
+		c := constraint.ParseConstraint(evalCtx, "/1: [/5 - /5]")
+		b := MakeBuilder(table, index)
+		spans, err := b.SpansFromConstraint(&c, exec.TableColumnOrdinalSet{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spans) != 1 {
+			t.Fatalf("expected exactly 1 span for a point lookup on a sharded index, got %d: %v", len(spans), spans)
+		}
+	})
+
+	t.Run("range fans out across every bucket", func(t *testing.T) {
+		c := constraint.ParseConstraint(evalCtx, "/1: [/5 - /10]")
+		b := MakeBuilder(table, index)
+		spans, err := b.SpansFromConstraint(&c, exec.TableColumnOrdinalSet{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spans) != buckets {
+			t.Fatalf("expected %d spans (one per bucket) for a range on a sharded index, got %d: %v", buckets, len(spans), spans)
+		}
+	})
+
+	t.Run("DisableShardedIndexFanOut keeps a single span", func(t *testing.T) {
+		c := constraint.ParseConstraint(evalCtx, "/1: [/5 - /5]")
+		b := MakeBuilder(table, index, DisableShardedIndexFanOut())
+		spans, err := b.SpansFromConstraint(&c, exec.TableColumnOrdinalSet{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spans) != 1 {
+			t.Fatalf("expected exactly 1 span with fan-out disabled, got %d: %v", len(spans), spans)
+		}
+	})
+
+	t.Run("IN constraint fans out one bucket per value", func(t *testing.T) {
+		c := constraint.ParseConstraint(evalCtx, "/1: [/1 - /1] [/3 - /3] [/7 - /7]")
+		b := MakeBuilder(table, index)
+		spans, err := b.SpansFromConstraint(&c, exec.TableColumnOrdinalSet{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spans) != 3 {
+			t.Fatalf("expected 1 span per IN value (each an exact-bucket point lookup), got %d: %v", len(spans), spans)
+		}
+	})
+}
+
+// TestSpansFromConstraintShardedSecondaryIndex covers a hash-sharded
+// secondary index that carries an implicit extra suffix column (as a
+// non-unique secondary index does, to make its key unique by appending the
+// primary key). numShardedCols in shardBucketsForConstraintSpan is computed
+// from the index descriptor's own ColumnDirections, which -- unlike the
+// Builder's internal indexColDirs built from FullColumnIDs() -- excludes
+// that implicit suffix, so equality and IN constraints on the index's own
+// columns must still resolve to a single bucket per value instead of
+// degrading to a full bucket scan.
+func TestSpansFromConstraintShardedSecondaryIndex(t *testing.T) {
+	const buckets = 4
+	index := sqlbase.IndexDescriptor{
+		ID:               2,
+		ColumnIDs:        []sqlbase.ColumnID{1, 2},
+		ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC, sqlbase.IndexDescriptor_ASC},
+		ExtraColumnIDs:   []sqlbase.ColumnID{3},
+		Sharded:          sqlbase.ShardedDescriptor{IsSharded: true, ShardBuckets: buckets},
+	}
+	table, index := makeTestTableAndIndex([]types.T{*types.Int, *types.Int, *types.Int}, index)
+	evalCtx := tree.NewTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	t.Run("equality resolves to one bucket", func(t *testing.T) {
+		c := constraint.ParseConstraint(evalCtx, "/1: [/9 - /9]")
+		b := MakeBuilder(table, index)
+		spans, err := b.SpansFromConstraint(&c, exec.TableColumnOrdinalSet{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spans) != 1 {
+			t.Fatalf("expected exactly 1 span for a point lookup on a sharded secondary index, got %d: %v", len(spans), spans)
+		}
+	})
+
+	t.Run("IN constraint fans out one bucket per value", func(t *testing.T) {
+		c := constraint.ParseConstraint(evalCtx, "/1: [/2 - /2] [/4 - /4]")
+		b := MakeBuilder(table, index)
+		spans, err := b.SpansFromConstraint(&c, exec.TableColumnOrdinalSet{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spans) != 2 {
+			t.Fatalf("expected 1 span per IN value on a sharded secondary index, got %d: %v", len(spans), spans)
+		}
+	})
+
+	t.Run("range scans every bucket", func(t *testing.T) {
+		c := constraint.ParseConstraint(evalCtx, "/1: [/1 - /20]")
+		b := MakeBuilder(table, index)
+		spans, err := b.SpansFromConstraint(&c, exec.TableColumnOrdinalSet{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spans) != buckets {
+			t.Fatalf("expected %d spans (one per bucket) for a range on a sharded secondary index, got %d: %v", buckets, len(spans), spans)
+		}
+	})
+}
+
+// TestHashedShardBucketMatchesShardColumnComputation checks that the bucket
+// the Builder computes for a point lookup matches the bucket a row with that
+// value would actually be stored under -- i.e. mod(fnv32(crdb_internal.
+// datums_to_bytes(cols...)), buckets), the expression a hash-sharded index's
+// computed shard column uses. It independently re-derives that expected
+// bucket (rather than calling encodeShardColumnValues/hashedShardBucket) so
+// that a regression back to hashing the key-encoded suffix would be caught.
+func TestHashedShardBucketMatchesShardColumnComputation(t *testing.T) {
+	const buckets = 8
+	index := sqlbase.IndexDescriptor{
+		ID:               1,
+		ColumnIDs:        []sqlbase.ColumnID{1, 2},
+		ColumnDirections: []sqlbase.IndexDescriptor_Direction{sqlbase.IndexDescriptor_ASC, sqlbase.IndexDescriptor_ASC},
+		Sharded:          sqlbase.ShardedDescriptor{IsSharded: true, ShardBuckets: buckets},
+	}
+	table, index := makeTestTableAndIndex([]types.T{*types.Int, *types.Int}, index)
+	evalCtx := tree.NewTestingEvalContext(cluster.MakeTestingClusterSettings())
+
+	for _, v := range []int64{5, 42, -7, 12345} {
+		valueBytes, err := sqlbase.EncodeTableValue(nil, index.ColumnIDs[1], tree.NewDInt(tree.DInt(v)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := fnv.New32()
+		_, _ = h.Write(valueBytes)
+		wantBucket := int32(h.Sum32() % uint32(buckets))
+
+		c := constraint.ParseConstraint(evalCtx, fmt.Sprintf("/1: [/%d - /%d]", v, v))
+		b := MakeBuilder(table, index)
+		spans, err := b.SpansFromConstraint(&c, exec.TableColumnOrdinalSet{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spans) != 1 {
+			t.Fatalf("value %d: expected exactly 1 span, got %d: %v", v, len(spans), spans)
+		}
+
+		shardKeyBytes := []byte(spans[0].Key)[len(b.KeyPrefix):]
+		_, gotBucket64, err := encoding.DecodeVarintAscending(shardKeyBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int32(gotBucket64) != wantBucket {
+			t.Fatalf("value %d: expected bucket %d (matching the shard column's own computation), got %d",
+				v, wantBucket, gotBucket64)
+		}
+	}
+}